@@ -1,7 +1,6 @@
 package chat
 
 import (
-	"errors"
 	"sync"
 	"time"
 
@@ -10,45 +9,134 @@ import (
 	"github.com/keybase/client/go/chat/globals"
 	"github.com/keybase/client/go/chat/types"
 	"github.com/keybase/client/go/chat/utils"
+	"github.com/keybase/client/go/encrypteddb"
+	"github.com/keybase/client/go/libkb"
 	"github.com/keybase/client/go/protocol/chat1"
 	"github.com/keybase/client/go/protocol/gregor1"
 )
 
+// ConvLoaderPriority orders queued conversations: higher values are
+// serviced first. Ties break FIFO on enqueue time.
+type ConvLoaderPriority int
+
+const (
+	ConvLoaderPriorityBackground ConvLoaderPriority = 0
+	ConvLoaderPriorityGeneral    ConvLoaderPriority = 5
+	ConvLoaderPriorityHigh       ConvLoaderPriority = 10
+)
+
+const (
+	convLoaderNumWorkers     = 5
+	convLoaderMaxAttempts    = 8
+	convLoaderInitialBackoff = 500 * time.Millisecond
+	convLoaderMaxBackoff     = time.Minute
+)
+
+// convLoaderJob is one queued conv load. It's persisted verbatim (minus
+// the derived heap index) so the queue survives a process restart.
+type convLoaderJob struct {
+	ConvID    chat1.ConversationID
+	UID       gregor1.UID
+	Priority  ConvLoaderPriority
+	QueuedAt  time.Time
+	Attempts  int
+	NextRetry time.Time
+
+	index int // heap.Interface bookkeeping, not persisted
+}
+
+// convLoaderPriorityQueue is a min-heap ordered so Pop always returns the
+// highest ConvLoaderPriority job, breaking ties by earliest QueuedAt.
+// NextRetry is not part of the ordering: Next hands out the top job only
+// once its NextRetry has elapsed, and while it waits it does not look at
+// jobs further down the heap, even ones that are already ready.
+type convLoaderPriorityQueue []*convLoaderJob
+
+func (q convLoaderPriorityQueue) Len() int { return len(q) }
+
+func (q convLoaderPriorityQueue) Less(i, j int) bool {
+	if q[i].Priority != q[j].Priority {
+		return q[i].Priority > q[j].Priority
+	}
+	return q[i].QueuedAt.Before(q[j].QueuedAt)
+}
+
+func (q convLoaderPriorityQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *convLoaderPriorityQueue) Push(x interface{}) {
+	job := x.(*convLoaderJob)
+	job.index = len(*q)
+	*q = append(*q, job)
+}
+
+func (q *convLoaderPriorityQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	job := old[n-1]
+	old[n-1] = nil
+	job.index = -1
+	*q = old[:n-1]
+	return job
+}
+
+// ConvLoaderStats summarizes the current queue for diagnostics.
+type ConvLoaderStats struct {
+	Queued   int
+	Attempts map[string]int
+}
+
+// BackgroundConvLoader prewarms ConvSource for conversations that aren't
+// necessarily on screen yet. The queueing/coordination logic lives behind
+// ConvLoadQueue (see convloadqueue.go); this type owns connect/offline
+// state and the worker pool that drains whatever queue it's given.
 type BackgroundConvLoader struct {
 	globals.Contextified
 	utils.DebugLabeler
 
+	sync.Mutex
+
 	connected bool
 	started   bool
-	queue     chan chat1.ConversationID
-	stop      chan bool
-	online    chan bool
-	offline   chan chan struct{}
+	stop      chan struct{}
+	shutdown  chan struct{}
 
-	loads chan chat1.ConversationID // for testing, make this and can check conv load successes
+	uid       gregor1.UID
+	queue     ConvLoadQueue
+	kvBackend KVBackend // set via NewBackgroundConvLoaderWithKVBackend; nil means local-only
 
-	sync.Mutex
+	loads chan chat1.ConversationID // for testing, make this and can check conv load successes
 }
 
 var _ types.ConvLoader = (*BackgroundConvLoader)(nil)
 
 func NewBackgroundConvLoader(g *globals.Context) *BackgroundConvLoader {
-	b := &BackgroundConvLoader{
+	return &BackgroundConvLoader{
 		Contextified: globals.NewContextified(g),
 		DebugLabeler: utils.NewDebugLabeler(g, "BackgroundConvLoader", false),
-		stop:         make(chan bool),
-		online:       make(chan bool, 1),
-		offline:      make(chan chan struct{}, 1),
 	}
+}
 
-	// start offline
-	b.offline <- make(chan struct{})
-
-	b.newQueue()
-
+// NewBackgroundConvLoaderWithKVBackend wires BackgroundConvLoader up to a
+// shared KVBackend so every device/process signed in as the same UID
+// coordinates which conversations get pre-warmed, instead of each one
+// pulling independently. Falls back to local-only queueing whenever the
+// backend is disconnected.
+func NewBackgroundConvLoaderWithKVBackend(g *globals.Context, backend KVBackend) *BackgroundConvLoader {
+	b := NewBackgroundConvLoader(g)
+	b.kvBackend = backend
 	return b
 }
 
+func (b *BackgroundConvLoader) edb() *encrypteddb.EncryptedDB {
+	return encrypteddb.New(b.G().ExternalG(), func(g *libkb.GlobalContext) *libkb.JSONLocalDb {
+		return g.LocalChatDb
+	}, b.G().ConvLoaderEncryptionKey)
+}
+
 func (b *BackgroundConvLoader) Connected(ctx context.Context) {
 	b.Lock()
 	defer b.Unlock()
@@ -56,9 +144,10 @@ func (b *BackgroundConvLoader) Connected(ctx context.Context) {
 	if b.connected {
 		return
 	}
-
 	b.connected = true
-	b.online <- true
+	if b.queue != nil {
+		b.queue.Connected(ctx)
+	}
 }
 
 func (b *BackgroundConvLoader) Disconnected(ctx context.Context) {
@@ -68,16 +157,9 @@ func (b *BackgroundConvLoader) Disconnected(ctx context.Context) {
 	if !b.connected {
 		return
 	}
-
 	b.connected = false
-	ch := make(chan struct{})
-	b.offline <- ch
-
-	// wait for loop to go offline
-	select {
-	case <-ch:
-	case <-time.After(3 * time.Second):
-		b.Debug(ctx, "timeout waiting for loop to go offline")
+	if b.queue != nil {
+		b.queue.Disconnected(ctx)
 	}
 }
 
@@ -90,93 +172,155 @@ func (b *BackgroundConvLoader) IsOffline() bool {
 
 func (b *BackgroundConvLoader) Start(ctx context.Context, uid gregor1.UID) {
 	b.Lock()
-	defer b.Unlock()
 
 	if b.started {
-		b.stop <- true
+		// Drain the old worker pool synchronously before swapping in a new
+		// queue/channels below - otherwise the old pool's completion
+		// goroutine and this call's close(b.shutdown) race to close the
+		// same (or a reassigned) channel.
+		close(b.stop)
+		b.started = false
+		oldShutdown := b.shutdown
+		b.Unlock()
+		<-oldShutdown
+		b.Lock()
 	}
 
-	b.newQueue()
+	b.uid = uid
+	if b.kvBackend != nil {
+		b.queue = newKVConvLoadQueue(b.edb(), b.kvBackend, uid)
+	} else {
+		b.queue = newMemConvLoadQueue(b.edb(), uid)
+	}
+	if b.connected {
+		b.queue.Connected(ctx)
+	}
 
+	stopCh := make(chan struct{})
+	shutdownCh := make(chan struct{})
+	b.stop = stopCh
+	b.shutdown = shutdownCh
 	b.started = true
-	go b.loop(uid)
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < convLoaderNumWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.worker(runCtx, uid)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(shutdownCh)
+	}()
+
+	b.Unlock()
 }
 
 func (b *BackgroundConvLoader) Stop(ctx context.Context) chan struct{} {
 	b.Lock()
 	defer b.Unlock()
 
+	ch := make(chan struct{})
 	if b.started {
-		b.stop <- true
+		close(b.stop)
 		b.started = false
+		shutdownCh := b.shutdown
+		go func() {
+			select {
+			case <-shutdownCh:
+			case <-time.After(5 * time.Second):
+			}
+			close(ch)
+		}()
+	} else {
+		close(ch)
 	}
-	ch := make(chan struct{})
-	close(ch)
 	return ch
 }
 
+// Queue preserves the pre-existing behavior: enqueue at general priority.
 func (b *BackgroundConvLoader) Queue(ctx context.Context, convID chat1.ConversationID) error {
+	return b.QueueWithPriority(ctx, convID, ConvLoaderPriorityGeneral)
+}
+
+// QueueWithPriority adds convID to the queue. If convID is already
+// queued, its priority is raised (never lowered) - a background prefetch
+// that later becomes foreground-visible jumps the line instead of
+// enqueuing twice.
+func (b *BackgroundConvLoader) QueueWithPriority(ctx context.Context, convID chat1.ConversationID,
+	priority ConvLoaderPriority) error {
 	b.Lock()
-	defer b.Unlock()
+	queue := b.queue
+	uid := b.uid
+	b.Unlock()
+	if queue == nil {
+		return nil
+	}
+	return queue.QueueWithPriority(ctx, uid, convID, priority)
+}
 
-	select {
-	case b.queue <- convID:
-		b.Debug(ctx, "added %s to queue")
-	default:
-		b.Debug(ctx, "queue is full, not adding %s", convID)
-		return errors.New("queue is full")
+// Cancel removes convID from the queue if it hasn't started loading yet.
+// It has no effect on a load already in flight.
+func (b *BackgroundConvLoader) Cancel(ctx context.Context, convID chat1.ConversationID) error {
+	b.Lock()
+	queue := b.queue
+	b.Unlock()
+	if queue == nil {
+		return nil
 	}
+	return queue.Cancel(ctx, convID)
+}
 
-	return nil
+func (b *BackgroundConvLoader) Stats() ConvLoaderStats {
+	b.Lock()
+	queue := b.queue
+	b.Unlock()
+	if queue == nil {
+		return ConvLoaderStats{}
+	}
+	return queue.Stats()
 }
 
-func (b *BackgroundConvLoader) loop(uid gregor1.UID) {
-	bgctx := context.Background()
-	b.Debug(bgctx, "starting conv loader loop for %s", uid)
+// worker pulls ready jobs and loads them, requeuing with backoff on
+// failure. ctx is cancelled on Stop/shutdown so an in-flight Pull is
+// abandoned promptly instead of finishing an offline-triggered load.
+func (b *BackgroundConvLoader) worker(ctx context.Context, uid gregor1.UID) {
 	for {
-		// get a convID from queue, go offline, or stop
-		select {
-		case convID := <-b.queue:
-			b.load(bgctx, convID, uid)
-		case x := <-b.offline:
-			b.Debug(bgctx, "loop went offline")
-			close(x)
-			select {
-			case <-b.online:
-				b.Debug(bgctx, "loop came online")
-			case <-b.stop:
-				b.Debug(bgctx, "shutting down (offline) conv loader loop for %s", uid)
-				return
-			}
-		case <-b.stop:
-			b.Debug(bgctx, "shutting down conv loader loop for %s", uid)
+		job, err := b.queue.Next(ctx)
+		if err != nil {
 			return
 		}
+		b.load(ctx, job, uid)
 	}
 }
 
-func (b *BackgroundConvLoader) newQueue() {
-	if b.queue != nil {
-		close(b.queue)
-	}
-	b.queue = make(chan chat1.ConversationID, 200)
-}
-
-func (b *BackgroundConvLoader) load(ctx context.Context, convID chat1.ConversationID, uid gregor1.UID) {
-	b.Debug(ctx, "loading conversation %s", convID)
+func (b *BackgroundConvLoader) load(ctx context.Context, job *convLoaderJob, uid gregor1.UID) {
+	convID := job.ConvID
+	b.Debug(ctx, "loading conversation %s (attempt %d)", convID, job.Attempts+1)
 
 	query := &chat1.GetThreadQuery{MarkAsRead: false}
 	pagination := &chat1.Pagination{Num: 50}
 	_, _, err := b.G().ConvSource.Pull(ctx, convID, uid, query, pagination)
 	if err != nil {
 		b.Debug(ctx, "ConvSource.Pull error: %s", err)
-	} else {
-		b.Debug(ctx, "loaded conversation %s", convID)
+		b.queue.Failed(ctx, job)
+		return
+	}
 
-		// if testing, put the convID on the loads channel
-		if b.loads != nil {
-			b.Debug(ctx, "putting convID %s on loads chan", convID)
-			b.loads <- convID
-		}
+	b.Debug(ctx, "loaded conversation %s", convID)
+	b.queue.Done(ctx, job)
+
+	// if testing, put the convID on the loads channel
+	if b.loads != nil {
+		b.Debug(ctx, "putting convID %s on loads chan", convID)
+		b.loads <- convID
 	}
 }
@@ -0,0 +1,457 @@
+package chat
+
+import (
+	"container/heap"
+	"encoding/hex"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/encrypteddb"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+)
+
+// ConvLoadQueue is the queueing side of BackgroundConvLoader, pulled out
+// behind an interface so multiple devices/processes for the same UID can
+// share a queue (kvConvLoadQueue) without BackgroundConvLoader itself
+// needing to know or care. memConvLoadQueue is the single-process default
+// and is what BackgroundConvLoader used inline before this split.
+type ConvLoadQueue interface {
+	// QueueWithPriority enqueues convID at the given priority, deduping on
+	// convID (raising, never lowering, an already-queued job's priority).
+	QueueWithPriority(ctx context.Context, uid gregor1.UID, convID chat1.ConversationID, priority ConvLoaderPriority) error
+	// Cancel removes convID if it hasn't been handed out by Next yet.
+	Cancel(ctx context.Context, convID chat1.ConversationID) error
+	// Stats summarizes queue occupancy for diagnostics.
+	Stats() ConvLoaderStats
+	// Next blocks until a job is ready, returning it. It returns
+	// ctx.Err() if ctx is cancelled first.
+	Next(ctx context.Context) (*convLoaderJob, error)
+	// Done marks job as successfully loaded.
+	Done(ctx context.Context, job *convLoaderJob)
+	// Failed requeues job with backoff/jitter, or drops it once
+	// convLoaderMaxAttempts is exhausted.
+	Failed(ctx context.Context, job *convLoaderJob)
+	// Connected/Disconnected let a distributed implementation know when
+	// it should participate in cross-device coordination versus falling
+	// back to local-only queueing.
+	Connected(ctx context.Context)
+	Disconnected(ctx context.Context)
+}
+
+// convLoaderQueueDbKey is where the queue snapshot for uid is persisted
+// between restarts.
+func convLoaderQueueDbKey(uid gregor1.UID) libkb.DbKey {
+	return libkb.DbKey{
+		Typ: libkb.DBChatBackgroundConvLoader,
+		Key: uid.String(),
+	}
+}
+
+// memConvLoadQueue is a single-process priority queue for background conv
+// loads, persisted to encrypteddb so it survives a restart. This is
+// BackgroundConvLoader's original (pre-extraction) queueing behavior.
+type memConvLoadQueue struct {
+	sync.Mutex
+
+	uid    gregor1.UID
+	edb    *encrypteddb.EncryptedDB
+	pq     convLoaderPriorityQueue
+	seen   map[string]*convLoaderJob // convID.String() -> job, for dedup/Cancel
+	notify chan struct{}             // signals a waiting Next that pq changed
+}
+
+var _ ConvLoadQueue = (*memConvLoadQueue)(nil)
+
+func newMemConvLoadQueue(edb *encrypteddb.EncryptedDB, uid gregor1.UID) *memConvLoadQueue {
+	q := &memConvLoadQueue{
+		uid:    uid,
+		edb:    edb,
+		seen:   make(map[string]*convLoaderJob),
+		notify: make(chan struct{}, 1),
+	}
+	q.loadPersisted(context.Background())
+	return q
+}
+
+func (q *memConvLoadQueue) QueueWithPriority(ctx context.Context, uid gregor1.UID,
+	convID chat1.ConversationID, priority ConvLoaderPriority) error {
+	q.Lock()
+	defer q.Unlock()
+
+	key := convID.String()
+	if job, ok := q.seen[key]; ok {
+		if priority > job.Priority {
+			job.Priority = priority
+			// job.index is -1 while Next has it checked out (heap.Pop
+			// clears it on the way out); there's nothing in q.pq to fix up
+			// in that case; the raised Priority still took effect above,
+			// and Failed will heap.Push the job back in if the load fails.
+			if job.index >= 0 {
+				heap.Fix(&q.pq, job.index)
+			}
+		}
+		return nil
+	}
+
+	job := &convLoaderJob{
+		ConvID:   convID,
+		UID:      uid,
+		Priority: priority,
+		QueuedAt: time.Now(),
+	}
+	heap.Push(&q.pq, job)
+	q.seen[key] = job
+	q.persistLocked(ctx)
+	q.wake()
+	return nil
+}
+
+func (q *memConvLoadQueue) Cancel(ctx context.Context, convID chat1.ConversationID) error {
+	q.Lock()
+	defer q.Unlock()
+
+	key := convID.String()
+	job, ok := q.seen[key]
+	if !ok {
+		return nil
+	}
+	if job.index < 0 {
+		// Already handed out by Next; Done/Failed own it from here.
+		return nil
+	}
+	heap.Remove(&q.pq, job.index)
+	delete(q.seen, key)
+	q.persistLocked(ctx)
+	return nil
+}
+
+func (q *memConvLoadQueue) Stats() ConvLoaderStats {
+	q.Lock()
+	defer q.Unlock()
+
+	stats := ConvLoaderStats{
+		Queued:   len(q.pq),
+		Attempts: make(map[string]int, len(q.seen)),
+	}
+	for k, job := range q.seen {
+		stats.Attempts[k] = job.Attempts
+	}
+	return stats
+}
+
+func (q *memConvLoadQueue) Next(ctx context.Context) (*convLoaderJob, error) {
+	for {
+		wait := time.Minute
+		q.Lock()
+		if len(q.pq) > 0 {
+			if next := q.pq[0]; !next.NextRetry.After(time.Now()) {
+				job := heap.Pop(&q.pq).(*convLoaderJob)
+				q.Unlock()
+				return job, nil
+			} else {
+				wait = q.pq[0].NextRetry.Sub(time.Now())
+			}
+		}
+		q.Unlock()
+
+		select {
+		case <-q.notify:
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (q *memConvLoadQueue) Done(ctx context.Context, job *convLoaderJob) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.seen, job.ConvID.String())
+	q.persistLocked(ctx)
+}
+
+func (q *memConvLoadQueue) Failed(ctx context.Context, job *convLoaderJob) {
+	q.Lock()
+	defer q.Unlock()
+
+	job.Attempts++
+	if job.Attempts >= convLoaderMaxAttempts {
+		delete(q.seen, job.ConvID.String())
+		q.persistLocked(ctx)
+		return
+	}
+
+	backoff := convLoaderInitialBackoff * time.Duration(1<<uint(job.Attempts-1))
+	if backoff > convLoaderMaxBackoff {
+		backoff = convLoaderMaxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(backoff) / 2))
+	job.NextRetry = time.Now().Add(backoff + jitter)
+	heap.Push(&q.pq, job)
+	q.persistLocked(ctx)
+	q.wake()
+}
+
+// Requeue puts job back on the heap after backoff without touching
+// Attempts or the retry/backoff schedule Failed owns. It's for callers
+// that pulled job off the queue but couldn't make progress for a reason
+// unrelated to the load itself (e.g. kvConvLoadQueue losing a coordination
+// lock to a sibling device), so the job's error budget isn't spent on
+// something that isn't an error.
+func (q *memConvLoadQueue) Requeue(ctx context.Context, job *convLoaderJob, backoff time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+	job.NextRetry = time.Now().Add(backoff)
+	heap.Push(&q.pq, job)
+	q.persistLocked(ctx)
+	q.wake()
+}
+
+func (q *memConvLoadQueue) Connected(ctx context.Context)    {}
+func (q *memConvLoadQueue) Disconnected(ctx context.Context) {}
+
+func (q *memConvLoadQueue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *memConvLoadQueue) persistLocked(ctx context.Context) {
+	jobs := make([]convLoaderJob, 0, len(q.seen))
+	for _, job := range q.seen {
+		jobs = append(jobs, *job)
+	}
+	_ = q.edb.Put(ctx, convLoaderQueueDbKey(q.uid), jobs)
+}
+
+func (q *memConvLoadQueue) loadPersisted(ctx context.Context) {
+	var jobs []convLoaderJob
+	found, err := q.edb.Get(ctx, convLoaderQueueDbKey(q.uid), &jobs)
+	if err != nil || !found {
+		return
+	}
+	for i := range jobs {
+		job := jobs[i]
+		heap.Push(&q.pq, &job)
+		q.seen[job.ConvID.String()] = &job
+	}
+}
+
+// KVBackend is the pluggable coordination backend a kvConvLoadQueue uses
+// to distribute conv loads across every device/process signed in as the
+// same UID. Implementations wrap etcd/consul/zk or similar; none are
+// provided here, this is the seam a real backend plugs into.
+type KVBackend interface {
+	// Watch streams the full key (not just the portion past prefix) of
+	// every Put made under prefix by any participant, including this one,
+	// until ctx is done or the backend disconnects. Implementations must
+	// not strip prefix before delivering a key.
+	Watch(ctx context.Context, prefix string) (<-chan string, error)
+	Put(ctx context.Context, key, val string) error
+	Delete(ctx context.Context, key string) error
+	// Lock takes a short-lived, auto-expiring lock on key so only one
+	// participant pulls a given conv at a time. unlock releases it early;
+	// callers must still tolerate the lock expiring under them and losing
+	// the race to another participant.
+	Lock(ctx context.Context, key string, ttl time.Duration) (unlock func(), err error)
+	// Capabilities reports which optional features the backend supports.
+	// kvConvLoadQueue does not call it; it drives every backend the same way.
+	Capabilities() KVBackendCapabilities
+}
+
+// KVBackendCapabilities describes what a KVBackend supports. Backends are
+// swapped without touching chat.BackgroundConvLoader callers; kvConvLoadQueue
+// itself does not branch on any of these fields.
+type KVBackendCapabilities struct {
+	// UseAPIV3 reports that the backend multiplexes Watch over a single
+	// stream instead of one per prefix. kvConvLoadQueue does not read it.
+	UseAPIV3 bool
+}
+
+const (
+	convLoadQueueLockTTL = 30 * time.Second
+
+	// convLoadQueueLockContentionBackoff is how long kvConvLoadQueue waits
+	// before retrying a job it lost a coordination lock on. Short relative
+	// to convLoadQueueLockTTL, and fixed rather than growing like Failed's
+	// backoff, since losing the lock isn't a failure, just news that a
+	// sibling device got there first.
+	convLoadQueueLockContentionBackoff = 3 * time.Second
+)
+
+// kvConvLoadQueue coordinates conv prewarming across every device/process
+// signed in as the same UID via a KVBackend, so the same conversation
+// isn't pulled redundantly by several devices at once. It falls back to
+// local-only queueing (via the embedded memConvLoadQueue) while
+// Disconnected is in effect. An unreachable backend is not detected as
+// such: while connected, a failed Lock is treated as contention, so the
+// job is requeued until a Lock succeeds or Disconnected is called.
+type kvConvLoadQueue struct {
+	*memConvLoadQueue
+
+	backend KVBackend
+	uid     gregor1.UID
+
+	sync.Mutex
+	watchCancel    context.CancelFunc
+	pendingUnlocks map[string]func()
+}
+
+var _ ConvLoadQueue = (*kvConvLoadQueue)(nil)
+
+func newKVConvLoadQueue(edb *encrypteddb.EncryptedDB, backend KVBackend, uid gregor1.UID) *kvConvLoadQueue {
+	q := &kvConvLoadQueue{
+		memConvLoadQueue: newMemConvLoadQueue(edb, uid),
+		backend:          backend,
+		uid:              uid,
+	}
+	q.Connected(context.Background())
+	return q
+}
+
+func (q *kvConvLoadQueue) convPrefix() string {
+	return "convloader/" + q.uid.String() + "/"
+}
+
+func (q *kvConvLoadQueue) QueueWithPriority(ctx context.Context, uid gregor1.UID,
+	convID chat1.ConversationID, priority ConvLoaderPriority) error {
+	if err := q.memConvLoadQueue.QueueWithPriority(ctx, uid, convID, priority); err != nil {
+		return err
+	}
+	if !q.coordinating() {
+		return nil
+	}
+	// Best effort: tell other devices about this conv. If the backend is
+	// down we still made progress locally.
+	_ = q.backend.Put(ctx, q.convPrefix()+convID.String(), convID.String())
+	return nil
+}
+
+// Next defers to the local queue for ordering, but wraps the winning job
+// in a short-lived backend lock so a sibling device racing on the same
+// convID backs off instead of doing duplicate work. If the lock can't be
+// acquired, the job is requeued and retried after
+// convLoadQueueLockContentionBackoff. While Disconnected is in effect no
+// lock is taken and the local job is returned as is.
+func (q *kvConvLoadQueue) Next(ctx context.Context) (*convLoaderJob, error) {
+	for {
+		job, err := q.memConvLoadQueue.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !q.coordinating() {
+			return job, nil
+		}
+		unlock, err := q.backend.Lock(ctx, q.convPrefix()+job.ConvID.String(), convLoadQueueLockTTL)
+		if err != nil {
+			// Someone else has it, or the backend's unreachable; the two
+			// aren't told apart. Either way it's not a load failure, so
+			// requeue without burning one of job's Attempts.
+			q.memConvLoadQueue.Requeue(ctx, job, convLoadQueueLockContentionBackoff)
+			continue
+		}
+		q.rememberUnlock(job, unlock)
+		return job, nil
+	}
+}
+
+// unlocks tracks the in-flight lock-release funcs for jobs Next has
+// handed out but Done/Failed hasn't resolved yet.
+func (q *kvConvLoadQueue) rememberUnlock(job *convLoaderJob, unlock func()) {
+	q.Lock()
+	defer q.Unlock()
+	if q.pendingUnlocks == nil {
+		q.pendingUnlocks = make(map[string]func())
+	}
+	q.pendingUnlocks[job.ConvID.String()] = unlock
+}
+
+func (q *kvConvLoadQueue) releaseLock(convID chat1.ConversationID) {
+	q.Lock()
+	unlock := q.pendingUnlocks[convID.String()]
+	delete(q.pendingUnlocks, convID.String())
+	q.Unlock()
+	if unlock != nil {
+		unlock()
+	}
+}
+
+func (q *kvConvLoadQueue) Done(ctx context.Context, job *convLoaderJob) {
+	q.memConvLoadQueue.Done(ctx, job)
+	_ = q.backend.Delete(ctx, q.convPrefix()+job.ConvID.String())
+	q.releaseLock(job.ConvID)
+}
+
+func (q *kvConvLoadQueue) Failed(ctx context.Context, job *convLoaderJob) {
+	q.memConvLoadQueue.Failed(ctx, job)
+	q.releaseLock(job.ConvID)
+}
+
+// coordinating reports whether q is taking part in cross-device
+// coordination, i.e. Connected has been called more recently than
+// Disconnected.
+func (q *kvConvLoadQueue) coordinating() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.watchCancel != nil
+}
+
+func (q *kvConvLoadQueue) Connected(ctx context.Context) {
+	q.Lock()
+	defer q.Unlock()
+	if q.watchCancel != nil {
+		return
+	}
+	watchCtx, cancel := context.WithCancel(context.Background())
+	q.watchCancel = cancel
+	go q.watchLoop(watchCtx)
+}
+
+func (q *kvConvLoadQueue) Disconnected(ctx context.Context) {
+	q.Lock()
+	defer q.Unlock()
+	if q.watchCancel == nil {
+		return
+	}
+	q.watchCancel()
+	q.watchCancel = nil
+	// memConvLoadQueue keeps serving Next()/QueueWithPriority() locally,
+	// we've just stopped cross-device coordination.
+}
+
+// watchLoop picks up convIDs enqueued by other devices under our UID's
+// prefix and folds them into the local queue at background priority, so
+// a fresh device coming online doesn't miss what siblings already queued.
+func (q *kvConvLoadQueue) watchLoop(ctx context.Context) {
+	ch, err := q.backend.Watch(ctx, q.convPrefix())
+	if err != nil {
+		return
+	}
+	for {
+		select {
+		case key, ok := <-ch:
+			if !ok {
+				return
+			}
+			// Watch yields full keys (q.convPrefix()+convID.String()),
+			// matching what QueueWithPriority puts under that prefix;
+			// strip it back off before hex-decoding the convID.
+			hexID := strings.TrimPrefix(key, q.convPrefix())
+			raw, err := hex.DecodeString(hexID)
+			if err != nil {
+				continue
+			}
+			convID := chat1.ConversationID(raw)
+			_ = q.memConvLoadQueue.QueueWithPriority(ctx, q.uid, convID, ConvLoaderPriorityBackground)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
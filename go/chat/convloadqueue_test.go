@@ -0,0 +1,120 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/encrypteddb"
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+)
+
+func newTestEDB(t *testing.T, tc libkb.TestContext) *encrypteddb.EncryptedDB {
+	key, err := libkb.RandBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fkey [32]byte
+	copy(fkey[:], key)
+	return encrypteddb.New(tc.G, func(g *libkb.GlobalContext) *libkb.JSONLocalDb {
+		return g.LocalChatDb
+	}, func(context.Context) ([32]byte, error) { return fkey, nil })
+}
+
+func TestQueueWithPriorityRaiseWhileInFlightDoesNotPanic(t *testing.T) {
+	tc := libkb.SetupTest(t, "convloadqueue", 1)
+	defer tc.Cleanup()
+	ctx := context.Background()
+	uid := gregor1.UID("uid")
+	convID := chat1.ConversationID("conv1")
+
+	q := newMemConvLoadQueue(newTestEDB(t, tc), uid)
+	if err := q.QueueWithPriority(ctx, uid, convID, ConvLoaderPriorityBackground); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := q.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.index != -1 {
+		t.Fatalf("expected Next to pop the job off the heap, got index %d", job.index)
+	}
+
+	// The background->foreground jump-the-line case: raising priority on
+	// a job Next already checked out used to index q.pq[-1] and panic.
+	if err := q.QueueWithPriority(ctx, uid, convID, ConvLoaderPriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	if job.Priority != ConvLoaderPriorityHigh {
+		t.Fatalf("expected raised priority to take effect, got %v", job.Priority)
+	}
+}
+
+func TestFailedBacksOffThenDropsAfterMaxAttempts(t *testing.T) {
+	tc := libkb.SetupTest(t, "convloadqueue", 1)
+	defer tc.Cleanup()
+	ctx := context.Background()
+	uid := gregor1.UID("uid")
+	convID := chat1.ConversationID("conv1")
+
+	q := newMemConvLoadQueue(newTestEDB(t, tc), uid)
+	if err := q.QueueWithPriority(ctx, uid, convID, ConvLoaderPriorityGeneral); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt := 1; attempt <= convLoaderMaxAttempts; attempt++ {
+		job, err := q.Next(ctx)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", attempt, err)
+		}
+		before := job.NextRetry
+		q.Failed(ctx, job)
+
+		if attempt < convLoaderMaxAttempts {
+			if job.Attempts != attempt {
+				t.Fatalf("expected Attempts %d, got %d", attempt, job.Attempts)
+			}
+			if !job.NextRetry.After(before) {
+				t.Fatalf("expected NextRetry to move forward on attempt %d", attempt)
+			}
+			if _, ok := q.seen[convID.String()]; !ok {
+				t.Fatalf("expected job to still be tracked after attempt %d", attempt)
+			}
+			// Clear the backoff so the next loop iteration's Next doesn't
+			// have to sleep out a real retry window.
+			q.Lock()
+			job.NextRetry = time.Time{}
+			q.Unlock()
+			q.wake()
+		} else if _, ok := q.seen[convID.String()]; ok {
+			t.Fatal("expected job to be dropped once convLoaderMaxAttempts is reached")
+		}
+	}
+}
+
+func TestQueuePersistsAcrossRestart(t *testing.T) {
+	tc := libkb.SetupTest(t, "convloadqueue", 1)
+	defer tc.Cleanup()
+	ctx := context.Background()
+	uid := gregor1.UID("uid")
+	convID := chat1.ConversationID("conv1")
+	edb := newTestEDB(t, tc)
+
+	q := newMemConvLoadQueue(edb, uid)
+	if err := q.QueueWithPriority(ctx, uid, convID, ConvLoaderPriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newMemConvLoadQueue(edb, uid)
+	stats := restarted.Stats()
+	if stats.Queued != 1 {
+		t.Fatalf("expected the persisted job to survive a restart, got Queued=%d", stats.Queued)
+	}
+	if _, ok := stats.Attempts[convID.String()]; !ok {
+		t.Fatal("expected the restarted queue to know about convID")
+	}
+}
@@ -0,0 +1,50 @@
+package chat
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/protocol/chat1"
+	"github.com/keybase/client/go/protocol/gregor1"
+)
+
+// lockContentionKVBackend always fails Lock, simulating a conv another
+// device is already pulling.
+type lockContentionKVBackend struct{}
+
+func (lockContentionKVBackend) Watch(ctx context.Context, prefix string) (<-chan string, error) {
+	return make(chan string), nil
+}
+func (lockContentionKVBackend) Put(ctx context.Context, key, val string) error { return nil }
+func (lockContentionKVBackend) Delete(ctx context.Context, key string) error   { return nil }
+func (lockContentionKVBackend) Capabilities() KVBackendCapabilities           { return KVBackendCapabilities{} }
+func (lockContentionKVBackend) Lock(ctx context.Context, key string, ttl time.Duration) (func(), error) {
+	return nil, context.DeadlineExceeded
+}
+
+func TestLockContentionDoesNotBurnAttempts(t *testing.T) {
+	tc := libkb.SetupTest(t, "convloadqueue", 1)
+	defer tc.Cleanup()
+	uid := gregor1.UID("uid")
+	convID := chat1.ConversationID("conv1")
+
+	q := newKVConvLoadQueue(newTestEDB(t, tc), lockContentionKVBackend{}, uid)
+	ctx := context.Background()
+	if err := q.QueueWithPriority(ctx, uid, convID, ConvLoaderPriorityGeneral); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := q.Next(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected Next to block on unresolvable lock contention until ctx expired, got %v", err)
+	}
+
+	stats := q.Stats()
+	if attempts, ok := stats.Attempts[convID.String()]; !ok || attempts != 0 {
+		t.Fatalf("expected lock contention to leave Attempts untouched, got %d (ok=%v)", attempts, ok)
+	}
+}
@@ -0,0 +1,156 @@
+// Package chunkstore is a content-addressed store for large values (chat
+// attachment chunks, thread caches) built on top of encrypteddb. Chunks
+// are addressed by the BLAKE2b-256 hash of their plaintext, so repeated
+// forwards of the same image or thread cache reuse storage instead of
+// duplicating it, similar to the CID-based split ipfs/bitswap uses for
+// its blockstore.
+package chunkstore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/encrypteddb"
+	"github.com/keybase/client/go/libkb"
+)
+
+// chunkSize is the plaintext size each chunk is split on. Fixed-size
+// chunking is simple and good enough for exact-duplicate dedup (repeated
+// forwards of the same attachment); content-defined (Rabin) chunking
+// would additionally dedup near-duplicates that differ by an insertion,
+// but isn't implemented here.
+const chunkSize = 64 * 1024
+
+// dbKeyType namespaces chunkstore's keys within the underlying
+// encrypteddb so it can share a JSONLocalDb with other callers without
+// key collisions.
+const dbKeyType = libkb.DBChunkstore
+
+// ChunkHash is the BLAKE2b-256 digest of a chunk's plaintext.
+type ChunkHash [32]byte
+
+func (h ChunkHash) String() string { return hex.EncodeToString(h[:]) }
+
+// Manifest describes a value as an ordered list of content-addressed
+// chunks, so Get can reassemble them in order and Delete knows which
+// chunks to drop a reference to.
+type Manifest struct {
+	Chunks     []ChunkHash
+	TotalBytes int64
+}
+
+// Store is a content-addressed chunk store layered on an EncryptedDB.
+// Not threadsafe, matching EncryptedDB's own contract.
+type Store struct {
+	edb *encrypteddb.EncryptedDB
+}
+
+func New(edb *encrypteddb.EncryptedDB) *Store {
+	return &Store{edb: edb}
+}
+
+func chunkDbKey(hash ChunkHash) libkb.DbKey {
+	return libkb.DbKey{Typ: dbKeyType, Key: "chunk-" + hash.String()}
+}
+
+func refcountDbKey(hash ChunkHash) libkb.DbKey {
+	return libkb.DbKey{Typ: dbKeyType, Key: "refcount-" + hash.String()}
+}
+
+// Put hashes r's content chunk by chunk, storing each previously-unseen
+// chunk exactly once and bumping a refcount for chunks that already
+// exist, then returns a manifest describing the result.
+func (s *Store) Put(ctx context.Context, r io.Reader) (Manifest, error) {
+	var manifest Manifest
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			hash := blake2b.Sum256(buf[:n])
+			if err := s.putChunk(ctx, hash, buf[:n]); err != nil {
+				return Manifest{}, err
+			}
+			manifest.Chunks = append(manifest.Chunks, hash)
+			manifest.TotalBytes += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return Manifest{}, err
+		}
+	}
+	return manifest, nil
+}
+
+// putChunk stores hash's plaintext if it isn't already present, and
+// bumps its refcount either way.
+func (s *Store) putChunk(ctx context.Context, hash ChunkHash, dat []byte) error {
+	key := chunkDbKey(hash)
+	_, found, err := s.edb.GetRaw(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		if err := s.edb.PutRaw(ctx, key, dat); err != nil {
+			return err
+		}
+	}
+	_, err = s.bumpRefcount(ctx, hash, 1)
+	return err
+}
+
+func (s *Store) bumpRefcount(ctx context.Context, hash ChunkHash, delta int) (int, error) {
+	var count int
+	if _, err := s.edb.Get(ctx, refcountDbKey(hash), &count); err != nil {
+		return 0, err
+	}
+	count += delta
+	if count <= 0 {
+		return 0, s.edb.Delete(ctx, refcountDbKey(hash))
+	}
+	if err := s.edb.Put(ctx, refcountDbKey(hash), count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Get reassembles the plaintext described by manifest, in chunk order.
+func (s *Store) Get(ctx context.Context, manifest Manifest) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	for _, hash := range manifest.Chunks {
+		dat, found, err := s.edb.GetRaw(ctx, chunkDbKey(hash))
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("chunkstore: missing chunk %s", hash)
+		}
+		buf.Write(dat)
+	}
+	return ioutil.NopCloser(&buf), nil
+}
+
+// Delete drops manifest's reference to each of its chunks, removing the
+// underlying chunk once its refcount reaches zero so it isn't deleted out
+// from under another manifest that still references it.
+func (s *Store) Delete(ctx context.Context, manifest Manifest) error {
+	for _, hash := range manifest.Chunks {
+		count, err := s.bumpRefcount(ctx, hash, -1)
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			if err := s.edb.Delete(ctx, chunkDbKey(hash)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
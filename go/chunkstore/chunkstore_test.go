@@ -0,0 +1,125 @@
+package chunkstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/encrypteddb"
+	"github.com/keybase/client/go/libkb"
+)
+
+func setupStoreTest(t *testing.T) (*Store, func()) {
+	tc := libkb.SetupTest(t, "chunkstore", 1)
+	key, err := libkb.RandBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fkey [32]byte
+	copy(fkey[:], key)
+	edb := encrypteddb.New(tc.G, func(g *libkb.GlobalContext) *libkb.JSONLocalDb {
+		return g.LocalChatDb
+	}, func(context.Context) ([32]byte, error) { return fkey, nil })
+	return New(edb), tc.Cleanup
+}
+
+func TestPutGetRoundTrip(t *testing.T) {
+	s, cleanup := setupStoreTest(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("a"), chunkSize+10)
+	manifest, err := s.Put(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.TotalBytes != int64(len(data)) {
+		t.Fatalf("got TotalBytes %d, expected %d", manifest.TotalBytes, len(data))
+	}
+
+	r, err := s.Get(ctx, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("round-tripped data doesn't match")
+	}
+}
+
+func TestPutDedupesIdenticalContent(t *testing.T) {
+	s, cleanup := setupStoreTest(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("b"), chunkSize)
+	m1, err := s.Put(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := s.Put(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m1.Chunks[0] != m2.Chunks[0] {
+		t.Fatal("identical content should hash to the same chunk")
+	}
+
+	// Deleting one manifest's reference shouldn't remove the chunk out
+	// from under the other, still-live manifest.
+	if err := s.Delete(ctx, m1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, m2); err != nil {
+		t.Fatalf("chunk deleted while still referenced: %v", err)
+	}
+}
+
+func TestDeleteRemovesChunkAtZeroRefcount(t *testing.T) {
+	s, cleanup := setupStoreTest(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("c"), chunkSize)
+	manifest, err := s.Put(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, manifest); err == nil {
+		t.Fatal("expected Get to fail once the only reference is deleted")
+	}
+}
+
+func TestPutEmptyReaderYieldsEmptyManifest(t *testing.T) {
+	s, cleanup := setupStoreTest(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	manifest, err := s.Put(ctx, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Chunks) != 0 || manifest.TotalBytes != 0 {
+		t.Fatalf("expected empty manifest, got %+v", manifest)
+	}
+
+	r, err := s.Get(ctx, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("expected no data, got %d bytes", len(got))
+	}
+}
@@ -0,0 +1,262 @@
+package encrypteddb
+
+import (
+	"hash/fnv"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/keybase/client/go/libkb"
+	"golang.org/x/net/context"
+)
+
+const (
+	// defaultCacheBloomBits sizes the bloom filter for ~1M keys at a ~2%
+	// false positive rate. A false positive just means we fall through to
+	// disk, so erring large here is cheap; a bloom filter that's too small
+	// isn't.
+	defaultCacheBloomBits = 1 << 23 // 1MB of bits
+	defaultCacheBloomK    = 7
+
+	// defaultCacheMaxBytes caps the ARC plaintext cache. Chosen to hold a
+	// few thousand chat metadata/summary entries without competing with
+	// the rest of the app for memory.
+	defaultCacheMaxBytes = 16 * 1024 * 1024
+)
+
+// CacheMetrics is a point-in-time snapshot of cache effectiveness, meant
+// to be logged or shipped alongside the rest of libkb.GlobalContext's
+// runtime stats.
+type CacheMetrics struct {
+	BloomHits    int64 // definitely-absent, avoided a disk read entirely
+	CacheHits    int64 // plaintext served from the ARC cache
+	CacheMisses  int64 // present on disk but not cached; not counted while the cache is disabled
+	CacheBytes   int64 // current ARC occupancy
+	CacheEntries int64
+}
+
+// bloomFilter is a small self-contained Bloom filter over libkb.DbKey. It
+// only supports additions: EncryptedDB rebuilds it wholesale on Delete
+// rather than trying to clear individual bits, since bits are shared
+// across keys and can't be safely removed one at a time.
+type bloomFilter struct {
+	sync.RWMutex
+	bits []byte
+	k    int
+}
+
+func newBloomFilter(numBits, k int) *bloomFilter {
+	return &bloomFilter{
+		bits: make([]byte, (numBits+7)/8),
+		k:    k,
+	}
+}
+
+func (f *bloomFilter) indexes(key string) []uint32 {
+	idxs := make([]uint32, f.k)
+	numBits := uint32(len(f.bits) * 8)
+	// Double hashing (Kirsch-Mitzenmacher): derive k indexes from two
+	// independent hashes instead of running k separate hash functions.
+	h1 := fnv.New64a()
+	_, _ = h1.Write([]byte(key))
+	sum1 := h1.Sum64()
+	h2 := fnv.New64()
+	_, _ = h2.Write([]byte(key))
+	sum2 := h2.Sum64()
+	for i := 0; i < f.k; i++ {
+		idxs[i] = uint32((sum1 + uint64(i)*sum2) % uint64(numBits))
+	}
+	return idxs
+}
+
+func (f *bloomFilter) Add(key string) {
+	f.Lock()
+	defer f.Unlock()
+	for _, idx := range f.indexes(key) {
+		f.bits[idx/8] |= 1 << (idx % 8)
+	}
+}
+
+// MightContain returns false only if key is definitely not present.
+func (f *bloomFilter) MightContain(key string) bool {
+	f.RLock()
+	defer f.RUnlock()
+	for _, idx := range f.indexes(key) {
+		if f.bits[idx/8]&(1<<(idx%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) Reset() {
+	f.Lock()
+	defer f.Unlock()
+	for i := range f.bits {
+		f.bits[i] = 0
+	}
+}
+
+// plaintextCache is a byte-capped ARC cache of decrypted values, keyed by
+// libkb.DbKey string. ARC (github.com/hashicorp/golang-lru) already
+// tracks both recency and frequency; we layer approximate byte accounting
+// on top since a chat conv summary and an avatar blob are wildly
+// different sizes and an entry-count cap would let either starve the
+// other.
+type plaintextCache struct {
+	sync.Mutex
+	arc      *lru.ARCCache
+	maxBytes int64
+	numBytes int64
+	sizes    map[string]int64
+}
+
+// arcEntryCapacity is deliberately large enough that ARC's own entry-count
+// eviction never fires before evictBytesLocked's byte-based eviction does;
+// otherwise ARC evicting an entry internally (e.g. many small values well
+// under maxBytes) would leave that entry's bytes uncounted in c.sizes
+// forever, leaking the map and permanently inflating numBytes. golang-lru
+// doesn't preallocate storage for this size, so sizing it generously costs
+// nothing up front.
+const arcEntryCapacity = 1 << 24
+
+func newPlaintextCache(maxBytes int64) (*plaintextCache, error) {
+	arc, err := lru.NewARC(arcEntryCapacity)
+	if err != nil {
+		return nil, err
+	}
+	return &plaintextCache{
+		arc:      arc,
+		maxBytes: maxBytes,
+		sizes:    make(map[string]int64),
+	}, nil
+}
+
+func (c *plaintextCache) Get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	v, ok := c.arc.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.([]byte), true
+}
+
+func (c *plaintextCache) Put(key string, val []byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.removeLocked(key)
+	c.arc.Add(key, val)
+	c.sizes[key] = int64(len(val))
+	c.numBytes += int64(len(val))
+	c.evictBytesLocked()
+}
+
+func (c *plaintextCache) Remove(key string) {
+	c.Lock()
+	defer c.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *plaintextCache) removeLocked(key string) {
+	if sz, ok := c.sizes[key]; ok {
+		c.numBytes -= sz
+		delete(c.sizes, key)
+		c.arc.Remove(key)
+	}
+}
+
+// evictBytesLocked drops least-recently-added entries (by ARC's own
+// eviction order) until we're back under budget.
+func (c *plaintextCache) evictBytesLocked() {
+	for c.numBytes > c.maxBytes && c.arc.Len() > 0 {
+		keys := c.arc.Keys()
+		if len(keys) == 0 {
+			return
+		}
+		victim := keys[0].(string)
+		if sz, ok := c.sizes[victim]; ok {
+			c.numBytes -= sz
+			delete(c.sizes, victim)
+		}
+		c.arc.Remove(victim)
+	}
+}
+
+func (c *plaintextCache) snapshot() (bytes, entries int64) {
+	c.Lock()
+	defer c.Unlock()
+	return c.numBytes, int64(c.arc.Len())
+}
+
+// EnableCache turns on the bloom+ARC read cache for i. It must be called
+// before any Get/Put traffic to avoid populating a partially-scanned
+// bloom filter; the scan itself happens lazily on the first call in.
+func (i *EncryptedDB) EnableCache() error {
+	cache, err := newPlaintextCache(defaultCacheMaxBytes)
+	if err != nil {
+		return err
+	}
+	i.cache = cache
+	i.bloom = newBloomFilter(defaultCacheBloomBits, defaultCacheBloomK)
+	return nil
+}
+
+func (i *EncryptedDB) ensureBloomPopulated(ctx context.Context) {
+	i.bloomOnce.Do(func() {
+		i.scanBloom(ctx)
+	})
+}
+
+// rebuildBloom clears and rescans the bloom filter from disk. Called
+// after Delete, since bits can't be safely cleared for a single key.
+func (i *EncryptedDB) rebuildBloom(ctx context.Context) {
+	i.bloom.Reset()
+	i.scanBloom(ctx)
+}
+
+func (i *EncryptedDB) scanBloom(ctx context.Context) {
+	db := i.getDB(i.G())
+	keys, err := db.KeysWithPrefix(libkb.DbKey{})
+	if err != nil {
+		return
+	}
+	for _, key := range keys {
+		i.bloom.Add(key.String())
+	}
+}
+
+// Metrics returns a snapshot of cache effectiveness. Callers typically
+// wire this into whatever periodic stats collection libkb.GlobalContext
+// already runs.
+func (i *EncryptedDB) Metrics() CacheMetrics {
+	m := CacheMetrics{
+		BloomHits:   i.bloomHits.snapshot(),
+		CacheHits:   i.cacheHits.snapshot(),
+		CacheMisses: i.cacheMisses.snapshot(),
+	}
+	if i.cache != nil {
+		m.CacheBytes, m.CacheEntries = i.cache.snapshot()
+	}
+	return m
+}
+
+// counter is a tiny atomic-free counter guarded by its own mutex, matching
+// the rest of this file's habit of small purpose-built types instead of
+// pulling in sync/atomic for a handful of int64 fields.
+type counter struct {
+	sync.Mutex
+	n int64
+}
+
+func (c *counter) inc() {
+	c.Lock()
+	c.n++
+	c.Unlock()
+}
+
+func (c *counter) snapshot() int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.n
+}
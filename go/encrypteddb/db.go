@@ -2,6 +2,7 @@ package encrypteddb
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/keybase/client/go/libkb"
 	"golang.org/x/crypto/nacl/secretbox"
@@ -9,18 +10,122 @@ import (
 )
 
 type DbFn func(g *libkb.GlobalContext) *libkb.JSONLocalDb
+
+// KeyFn is retained for callers that only ever encrypt/decrypt under the
+// current epoch. New code should prefer KeyProvider, which can also
+// service reads of values written under an older epoch.
 type KeyFn func(context.Context) ([32]byte, error)
 
-type boxedData struct {
-	V int
-	N [24]byte
-	E []byte
+// KeyProvider knows how to hand back secretbox keys for a given epoch, and
+// which epoch is current. Encryption always happens under CurrentEpoch;
+// decryption looks the key up by whatever epoch is recorded in boxedData.
+type KeyProvider interface {
+	// CurrentEpoch is the epoch new writes should be sealed under.
+	CurrentEpoch(ctx context.Context) (keyEpoch, error)
+	// KeyForEpoch returns the secretbox key for the given epoch.
+	KeyForEpoch(ctx context.Context, epoch keyEpoch) ([32]byte, error)
+}
+
+// keyEpoch identifies which key a value was sealed under. Epochs are
+// per-installation and monotonically increasing; they say nothing about
+// the cipher suite used, that's cryptoVersion.
+type keyEpoch int
+
+// staticKeyProvider adapts a plain KeyFn (single, un-rotated key) to the
+// KeyProvider interface so old callers keep working unmodified.
+type staticKeyProvider struct {
+	keyFn KeyFn
+}
+
+func newStaticKeyProvider(keyFn KeyFn) KeyProvider {
+	return &staticKeyProvider{keyFn: keyFn}
+}
+
+func (s *staticKeyProvider) CurrentEpoch(ctx context.Context) (keyEpoch, error) {
+	return 0, nil
+}
+
+func (s *staticKeyProvider) KeyForEpoch(ctx context.Context, epoch keyEpoch) ([32]byte, error) {
+	return s.keyFn(ctx)
+}
+
+// cryptoVersion identifies the cipher suite (not the key) a value was
+// sealed with. Each suite implements seal/open over a raw plaintext and a
+// key of its own choosing; only V1 is wired up to secretbox today, V2/V3
+// are reserved for the XChaCha20-Poly1305 and AES-256-GCM-SIV rollout.
+type cryptoVersion int
+
+const (
+	cryptoVersionSecretbox cryptoVersion = 1
+	cryptoVersionXChaCha20 cryptoVersion = 2
+	cryptoVersionAESGCMSIV cryptoVersion = 3
+
+	// currentCryptoVersion is the suite new writes are sealed under.
+	// ***
+	// If we change this, make sure to update the key derivation reason for all callers of EncryptedDB!
+	// ***
+	currentCryptoVersion = cryptoVersionSecretbox
+)
+
+// cipherSuite seals and opens a plaintext under a 32-byte key. Registered
+// suites live in cipherSuites below; Box/Unbox dispatch on boxedData.V.
+type cipherSuite interface {
+	seal(dat []byte, key *[32]byte) (boxedData, error)
+	open(boxed boxedData, key *[32]byte) ([]byte, error)
+}
+
+// cipherSuites is the registry of known suites, keyed by crypto version.
+// Adding a new suite here (and bumping currentCryptoVersion) is how we
+// roll to a stronger cipher without invalidating what's already on disk:
+// old values keep decrypting via their recorded V, new values seal under
+// the new one.
+var cipherSuites = map[cryptoVersion]cipherSuite{
+	cryptoVersionSecretbox: secretboxSuite{},
+}
+
+type secretboxSuite struct{}
+
+func (secretboxSuite) seal(dat []byte, key *[32]byte) (boxedData, error) {
+	nonce, err := libkb.RandBytes(24)
+	if err != nil {
+		return boxedData{}, err
+	}
+	var fnonce [24]byte
+	copy(fnonce[:], nonce)
+	return boxedData{
+		V: int(cryptoVersionSecretbox),
+		E: secretbox.Seal(nil, dat, &fnonce, key),
+		N: fnonce,
+	}, nil
+}
+
+func (secretboxSuite) open(boxed boxedData, key *[32]byte) ([]byte, error) {
+	pt, ok := secretbox.Open(nil, boxed.E, &boxed.N, key)
+	if !ok {
+		return nil, fmt.Errorf("failed to decrypt item")
+	}
+	return pt, nil
+}
+
+func suiteForVersion(v cryptoVersion) (cipherSuite, error) {
+	suite, ok := cipherSuites[v]
+	if !ok {
+		return nil, fmt.Errorf("bad crypto version: %d current: %d", v, currentCryptoVersion)
+	}
+	return suite, nil
 }
 
-// ***
-// If we change this, make sure to update the key derivation reason for all callers of EncryptedDB!
-// ***
-const cryptoVersion = 1
+// boxedData is map-encoded (libkb.MPackEncode does not set StructToArray),
+// so Epoch is keyed by its codec tag rather than a positional slot; adding
+// it here is byte-compatible with values sealed before epochs existed,
+// which is what lets Rewrap treat "no Epoch tag on disk" as epoch 0
+// instead of needing a format migration.
+type boxedData struct {
+	V     int
+	N     [24]byte
+	E     []byte
+	Epoch int `codec:"epoch,omitempty"`
+}
 
 // Handle to a db that encrypts values using nacl secretbox.
 // Does not encrypt keys.
@@ -28,42 +133,61 @@ const cryptoVersion = 1
 type EncryptedDB struct {
 	libkb.Contextified
 
-	getSecretBoxKey KeyFn
-	getDB           DbFn
+	keyProvider KeyProvider
+	getDB       DbFn
+
+	// Optional bloom+ARC read cache, enabled via EnableCache. Nil unless
+	// enabled, so uncached callers pay nothing extra.
+	cache     *plaintextCache
+	bloom     *bloomFilter
+	bloomOnce sync.Once
+
+	bloomHits   counter
+	cacheHits   counter
+	cacheMisses counter
 }
 
 func New(g *libkb.GlobalContext, getDB DbFn, getSecretBoxKey KeyFn) *EncryptedDB {
+	return NewWithKeyProvider(g, getDB, newStaticKeyProvider(getSecretBoxKey))
+}
+
+func NewWithKeyProvider(g *libkb.GlobalContext, getDB DbFn, keyProvider KeyProvider) *EncryptedDB {
 	return &EncryptedDB{
-		Contextified:    libkb.NewContextified(g),
-		getDB:           getDB,
-		getSecretBoxKey: getSecretBoxKey,
+		Contextified: libkb.NewContextified(g),
+		getDB:        getDB,
+		keyProvider:  keyProvider,
 	}
 }
 
 func Unbox(ctx context.Context, b []byte, getSecretBoxKey KeyFn) ([]byte, error) {
+	return unboxWithProvider(ctx, b, newStaticKeyProvider(getSecretBoxKey))
+}
+
+func unboxWithProvider(ctx context.Context, b []byte, keyProvider KeyProvider) ([]byte, error) {
 	var boxed boxedData
 	if err := libkb.MPackDecode(b, &boxed); err != nil {
 		return nil, err
 	}
-	if boxed.V > cryptoVersion {
-		return nil, fmt.Errorf("bad crypto version: %d current: %d", boxed.V,
-			cryptoVersion)
-	}
-	enckey, err := getSecretBoxKey(ctx)
+	suite, err := suiteForVersion(cryptoVersion(boxed.V))
 	if err != nil {
 		return nil, err
 	}
-	pt, ok := secretbox.Open(nil, boxed.E, &boxed.N, &enckey)
-	if !ok {
-		return nil, fmt.Errorf("failed to decrypt item")
+	enckey, err := keyProvider.KeyForEpoch(ctx, keyEpoch(boxed.Epoch))
+	if err != nil {
+		return nil, err
 	}
-	return pt, nil
+	return suite.open(boxed, &enckey)
 }
 
 func DecodeBox(ctx context.Context, b []byte, getSecretBoxKey KeyFn,
+	res interface{}) error {
+	return decodeBoxWithProvider(ctx, b, newStaticKeyProvider(getSecretBoxKey), res)
+}
+
+func decodeBoxWithProvider(ctx context.Context, b []byte, keyProvider KeyProvider,
 	res interface{}) error {
 	// Decode encrypted box
-	pt, err := Unbox(ctx, b, getSecretBoxKey)
+	pt, err := unboxWithProvider(ctx, b, keyProvider)
 	if err != nil {
 		return err
 	}
@@ -74,6 +198,18 @@ func DecodeBox(ctx context.Context, b []byte, getSecretBoxKey KeyFn,
 }
 
 func (i *EncryptedDB) GetRaw(ctx context.Context, key libkb.DbKey) ([]byte, bool, error) {
+	if i.cache != nil {
+		i.ensureBloomPopulated(ctx)
+		if !i.bloom.MightContain(key.String()) {
+			i.bloomHits.inc()
+			return nil, false, nil
+		}
+		if pt, ok := i.cache.Get(key.String()); ok {
+			i.cacheHits.inc()
+			return pt, true, nil
+		}
+	}
+
 	var err error
 	db := i.getDB(i.G())
 	b, found, err := db.GetRaw(key)
@@ -83,10 +219,14 @@ func (i *EncryptedDB) GetRaw(ctx context.Context, key libkb.DbKey) ([]byte, bool
 	if !found {
 		return nil, false, nil
 	}
-	res, err := Unbox(ctx, b, i.getSecretBoxKey)
+	res, err := unboxWithProvider(ctx, b, i.keyProvider)
 	if err != nil {
 		return nil, true, err
 	}
+	if i.cache != nil {
+		i.cacheMisses.inc()
+		i.cache.Put(key.String(), res)
+	}
 	return res, true, nil
 }
 
@@ -94,45 +234,44 @@ func (i *EncryptedDB) GetRaw(ctx context.Context, key libkb.DbKey) ([]byte, bool
 // Decodes into res
 // Returns (found, err). Res is valid only if (found && err == nil)
 func (i *EncryptedDB) Get(ctx context.Context, key libkb.DbKey, res interface{}) (bool, error) {
-	var err error
-	db := i.getDB(i.G())
-	b, found, err := db.GetRaw(key)
+	pt, found, err := i.GetRaw(ctx, key)
 	if err != nil {
 		return false, err
 	}
 	if !found {
 		return false, nil
 	}
-	if err = DecodeBox(ctx, b, i.getSecretBoxKey, res); err != nil {
+	if err := libkb.MPackDecode(pt, res); err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
 func Box(ctx context.Context, dat []byte, getSecretBoxKey KeyFn) ([]byte, error) {
-	enckey, err := getSecretBoxKey(ctx)
+	return boxWithProvider(ctx, dat, newStaticKeyProvider(getSecretBoxKey))
+}
+
+func boxWithProvider(ctx context.Context, dat []byte, keyProvider KeyProvider) ([]byte, error) {
+	epoch, err := keyProvider.CurrentEpoch(ctx)
 	if err != nil {
 		return nil, err
 	}
-	var nonce []byte
-	nonce, err = libkb.RandBytes(24)
+	enckey, err := keyProvider.KeyForEpoch(ctx, epoch)
 	if err != nil {
 		return nil, err
 	}
-	var fnonce [24]byte
-	copy(fnonce[:], nonce)
-	sealed := secretbox.Seal(nil, dat, &fnonce, &enckey)
-	boxed := boxedData{
-		V: cryptoVersion,
-		E: sealed,
-		N: fnonce,
+	suite, err := suiteForVersion(currentCryptoVersion)
+	if err != nil {
+		return nil, err
 	}
-
-	// Encode encrypted box
-	if dat, err = libkb.MPackEncode(boxed); err != nil {
+	boxed, err := suite.seal(dat, &enckey)
+	if err != nil {
 		return nil, err
 	}
-	return dat, nil
+	boxed.Epoch = int(epoch)
+
+	// Encode encrypted box
+	return libkb.MPackEncode(boxed)
 }
 
 func EncodeBox(ctx context.Context, data interface{}, getSecretBoxKey KeyFn) ([]byte, error) {
@@ -143,26 +282,121 @@ func EncodeBox(ctx context.Context, data interface{}, getSecretBoxKey KeyFn) ([]
 	return Box(ctx, dat, getSecretBoxKey)
 }
 
+func encodeBoxWithProvider(ctx context.Context, data interface{}, keyProvider KeyProvider) ([]byte, error) {
+	dat, err := libkb.MPackEncode(data)
+	if err != nil {
+		return nil, err
+	}
+	return boxWithProvider(ctx, dat, keyProvider)
+}
+
 func (i *EncryptedDB) Put(ctx context.Context, key libkb.DbKey, data interface{}) error {
-	db := i.getDB(i.G())
-	dat, err := EncodeBox(ctx, data, i.getSecretBoxKey)
+	pt, err := libkb.MPackEncode(data)
 	if err != nil {
 		return err
 	}
-	// Write out
-	return db.PutRaw(key, dat)
+	return i.PutRaw(ctx, key, pt)
 }
 
 func (i *EncryptedDB) PutRaw(ctx context.Context, key libkb.DbKey, dat []byte) error {
 	db := i.getDB(i.G())
-	dat, err := Box(ctx, dat, i.getSecretBoxKey)
+	boxed, err := boxWithProvider(ctx, dat, i.keyProvider)
 	if err != nil {
 		return err
 	}
-	return db.PutRaw(key, dat)
+	if err := db.PutRaw(key, boxed); err != nil {
+		return err
+	}
+	if i.cache != nil {
+		i.ensureBloomPopulated(ctx)
+		i.bloom.Add(key.String())
+		i.cache.Put(key.String(), dat)
+	}
+	return nil
 }
 
 func (i *EncryptedDB) Delete(ctx context.Context, key libkb.DbKey) error {
 	db := i.getDB(i.G())
-	return db.Delete(key)
+	if err := db.Delete(key); err != nil {
+		return err
+	}
+	if i.cache != nil {
+		i.cache.Remove(key.String())
+		// A bloom filter can't clear one key's bits without risking false
+		// negatives for other keys hashed into the same bits, so the only
+		// safe way to reflect a delete is a full rescan. Put only ever
+		// adds a bit, which is always safe to do incrementally.
+		i.rebuildBloom(ctx)
+	}
+	return nil
+}
+
+// Rewrap re-encrypts every value under keys matching prefix that isn't
+// already sealed under the current epoch and cipher suite. It's meant to
+// be run as a background/admin-triggered batch job after a key rotation
+// or cipher suite bump, so on-disk caches don't need to be invalidated
+// wholesale the way libkv-backed stores re-encrypt on a rolling basis
+// when moving to a newer certificate format.
+//
+// Keys under prefix that aren't boxedData (PutStream's chunk keys are raw
+// sealed bytes with no MPack framing) are counted in skipped rather than
+// treated as a fatal error, so a prefix that happens to cover both plain
+// Put values and stream chunks doesn't abort the whole batch partway
+// through.
+func (i *EncryptedDB) Rewrap(ctx context.Context, prefix libkb.DbKey) (rewrapped, skipped int, err error) {
+	db := i.getDB(i.G())
+	keys, err := db.KeysWithPrefix(prefix)
+	if err != nil {
+		return 0, 0, err
+	}
+	currentEpoch, err := i.keyProvider.CurrentEpoch(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, key := range keys {
+		b, found, err := db.GetRaw(key)
+		if err != nil {
+			return rewrapped, skipped, err
+		}
+		if !found {
+			continue
+		}
+		var boxed boxedData
+		if err := libkb.MPackDecode(b, &boxed); err != nil {
+			// Not boxedData at all (e.g. a PutStream chunk key) - nothing
+			// for Rewrap to do with it, and not a reason to abort the rest
+			// of the batch.
+			skipped++
+			continue
+		}
+		if _, err := suiteForVersion(cryptoVersion(boxed.V)); err != nil {
+			// A raw, unframed chunk key (or genuine corruption) can
+			// spuriously decode into a boxedData with a V that isn't a
+			// registered suite. That's just as much "not actually
+			// boxedData" as an outright decode error above, and just as
+			// much not a reason to abort the rest of the batch.
+			skipped++
+			continue
+		}
+		if cryptoVersion(boxed.V) == currentCryptoVersion && keyEpoch(boxed.Epoch) == currentEpoch {
+			// Already current, nothing to do.
+			continue
+		}
+		pt, err := unboxWithProvider(ctx, b, i.keyProvider)
+		if err != nil {
+			return rewrapped, skipped, err
+		}
+		newBox, err := boxWithProvider(ctx, pt, i.keyProvider)
+		if err != nil {
+			return rewrapped, skipped, err
+		}
+		if err := db.PutRaw(key, newBox); err != nil {
+			return rewrapped, skipped, err
+		}
+		if i.cache != nil {
+			i.cache.Put(key.String(), pt)
+		}
+		rewrapped++
+	}
+	return rewrapped, skipped, nil
 }
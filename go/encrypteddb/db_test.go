@@ -0,0 +1,127 @@
+package encrypteddb
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/libkb"
+)
+
+// twoEpochKeyProvider simulates a key rotation: current starts at 0 and
+// tests flip it to 1 mid-way to exercise Rewrap.
+type twoEpochKeyProvider struct {
+	current keyEpoch
+	keys    map[keyEpoch][32]byte
+}
+
+func (p *twoEpochKeyProvider) CurrentEpoch(ctx context.Context) (keyEpoch, error) {
+	return p.current, nil
+}
+
+func (p *twoEpochKeyProvider) KeyForEpoch(ctx context.Context, epoch keyEpoch) ([32]byte, error) {
+	return p.keys[epoch], nil
+}
+
+func newTwoEpochKeyProvider(t *testing.T) *twoEpochKeyProvider {
+	k0, err := libkb.RandBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k1, err := libkb.RandBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f0, f1 [32]byte
+	copy(f0[:], k0)
+	copy(f1[:], k1)
+	return &twoEpochKeyProvider{
+		current: 0,
+		keys:    map[keyEpoch][32]byte{0: f0, 1: f1},
+	}
+}
+
+func TestRewrapMovesValuesToTheCurrentEpochAndSkipsUnrewrappableKeys(t *testing.T) {
+	tc := libkb.SetupTest(t, "encrypteddb", 1)
+	defer tc.Cleanup()
+	ctx := context.Background()
+
+	provider := newTwoEpochKeyProvider(t)
+	edb := NewWithKeyProvider(tc.G, func(g *libkb.GlobalContext) *libkb.JSONLocalDb {
+		return g.LocalChatDb
+	}, provider)
+
+	prefixKey := libkb.DbKey{Typ: libkb.DBChunkstore, Key: "rewrap-test"}
+	if err := edb.Put(ctx, prefixKey, "epoch0-value"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A key under the same prefix that isn't boxedData at all - mirrors
+	// PutStream's raw, unframed chunk keys. Rewrap must skip it rather
+	// than abort the batch.
+	chunkKey := libkb.DbKey{Typ: libkb.DBChunkstore, Key: "rewrap-test||0"}
+	if err := tc.G.LocalChatDb.PutRaw(chunkKey, []byte("not boxed data")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A key whose raw bytes happen to decode as boxedData-shaped (this is
+	// what a PutStream chunk's raw secretbox output can do by chance) but
+	// with a V that isn't a registered suite. Rewrap must skip this too,
+	// rather than abort on the suiteForVersion error.
+	garbageVersionKey := libkb.DbKey{Typ: libkb.DBChunkstore, Key: "rewrap-test||1"}
+	garbageBoxed := boxedData{V: 99, E: []byte("garbage")}
+	garbageBytes, err := libkb.MPackEncode(garbageBoxed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.G.LocalChatDb.PutRaw(garbageVersionKey, garbageBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	provider.current = 1 // rotate to a new epoch
+
+	rewrapped, skipped, err := edb.Rewrap(ctx, libkb.DbKey{Typ: libkb.DBChunkstore, Key: "rewrap-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped != 1 {
+		t.Fatalf("expected 1 value rewrapped, got %d", rewrapped)
+	}
+	if skipped != 2 {
+		t.Fatalf("expected 2 non-rewrappable keys skipped, got %d", skipped)
+	}
+
+	var got string
+	found, err := edb.Get(ctx, prefixKey, &got)
+	if err != nil || !found {
+		t.Fatalf("value unreadable after rewrap: found=%v err=%v", found, err)
+	}
+	if got != "epoch0-value" {
+		t.Fatalf("got %q after rewrap", got)
+	}
+}
+
+// TestBoxedDataEpochFieldIsBackwardCompatible pins down the assumption
+// Rewrap relies on: MPack encodes boxedData by field tag (map encoding),
+// not position (StructToArray), so a value sealed before Epoch existed
+// decodes cleanly as epoch 0 instead of shifting N/E into the wrong
+// fields.
+func TestBoxedDataEpochFieldIsBackwardCompatible(t *testing.T) {
+	type legacyBoxedData struct {
+		V int
+		N [24]byte
+		E []byte
+	}
+	legacy := legacyBoxedData{V: 1, E: []byte("ciphertext")}
+	enc, err := libkb.MPackEncode(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded boxedData
+	if err := libkb.MPackDecode(enc, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.V != legacy.V || string(decoded.E) != string(legacy.E) || decoded.Epoch != 0 {
+		t.Fatalf("legacy-shaped boxedData decoded wrong: %+v", decoded)
+	}
+}
@@ -0,0 +1,246 @@
+package encrypteddb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/keybase/client/go/libkb"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/net/context"
+)
+
+// streamChunkSize is the plaintext size each chunk is split into before
+// sealing. Kept well under typical disk page / RPC framing sizes so a
+// single chunk read never has to materialize an entire large attachment.
+const streamChunkSize = 64 * 1024
+
+// streamHeader is stored at the value's own key and describes how to
+// reassemble the chunks stored at key||0, key||1, ....
+type streamHeader struct {
+	V          int    // crypto version the header itself (and each chunk) was sealed under
+	Epoch      int    // key epoch the chunks were sealed under; GetStream must re-derive the same key, not CurrentEpoch
+	NoncePfx   [16]byte
+	ChunkSize  int
+	NumChunks  int
+	PlainBytes int64 // total plaintext length, checked on read to detect a truncated stream
+}
+
+// streamChunkKey derives the on-disk key for chunk idx of key.
+func streamChunkKey(key libkb.DbKey, idx int) libkb.DbKey {
+	return libkb.DbKey{
+		Typ: key.Typ,
+		Key: fmt.Sprintf("%s||%d", key.Key, idx),
+	}
+}
+
+// chunkNonce derives a unique 24-byte nonce for chunk idx from the
+// per-value random prefix and the chunk's counter, so no nonce is ever
+// reused across chunks or across values without needing to persist a
+// full nonce per chunk.
+func chunkNonce(prefix [16]byte, idx uint64) [24]byte {
+	var nonce [24]byte
+	copy(nonce[:16], prefix[:])
+	binary.BigEndian.PutUint64(nonce[16:], idx)
+	return nonce
+}
+
+// PutStream splits the plaintext read from r into fixed-size chunks,
+// seals each one under its own derived nonce, and writes them out along
+// with a small header record at key describing how to reassemble them.
+// Intended for values too large to comfortably hold twice in memory the
+// way Put/Box do (chat attachments, thread caches).
+func (i *EncryptedDB) PutStream(ctx context.Context, key libkb.DbKey, r io.Reader) error {
+	suite, err := suiteForVersion(currentCryptoVersion)
+	if err != nil {
+		return err
+	}
+	if suite != (secretboxSuite{}) {
+		// Only the secretbox suite implements nonce-derived chunk sealing
+		// today; a future suite change needs its own chunk framing.
+		return fmt.Errorf("PutStream: unsupported crypto version %d", currentCryptoVersion)
+	}
+
+	epoch, err := i.keyProvider.CurrentEpoch(ctx)
+	if err != nil {
+		return err
+	}
+	enckey, err := i.keyProvider.KeyForEpoch(ctx, epoch)
+	if err != nil {
+		return err
+	}
+
+	prefixBytes, err := libkb.RandBytes(16)
+	if err != nil {
+		return err
+	}
+	var prefix [16]byte
+	copy(prefix[:], prefixBytes)
+
+	// If this overwrites an existing stream, remember how many chunks it
+	// had so we can clean up any that fall past the end of the new one;
+	// otherwise they're orphaned on disk (unreachable via the new header,
+	// never deleted).
+	var oldNumChunks int
+	var oldHeader streamHeader
+	if found, err := i.Get(ctx, key, &oldHeader); err == nil && found {
+		oldNumChunks = oldHeader.NumChunks
+	}
+
+	db := i.getDB(i.G())
+	buf := make([]byte, streamChunkSize)
+	var idx uint64
+	var total int64
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			nonce := chunkNonce(prefix, idx)
+			sealed := secretboxSealChunk(buf[:n], &nonce, &enckey)
+			if err := db.PutRaw(streamChunkKey(key, int(idx)), sealed); err != nil {
+				return err
+			}
+			total += int64(n)
+			idx++
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	header := streamHeader{
+		V:          int(currentCryptoVersion),
+		Epoch:      int(epoch),
+		NoncePfx:   prefix,
+		ChunkSize:  streamChunkSize,
+		NumChunks:  int(idx),
+		PlainBytes: total,
+	}
+	if err := i.Put(ctx, key, header); err != nil {
+		return err
+	}
+
+	// Drop any chunks the previous write left past the end of this one;
+	// they're unreachable via the header we just wrote.
+	for staleIdx := header.NumChunks; staleIdx < oldNumChunks; staleIdx++ {
+		if err := db.Delete(streamChunkKey(key, staleIdx)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// secretboxSealChunk seals one chunk under a nonce we've already derived,
+// bypassing cipherSuite.seal (which generates its own random nonce) since
+// chunk nonces must be deterministic to stay collision-free across a
+// stream without persisting one per chunk.
+func secretboxSealChunk(pt []byte, nonce *[24]byte, key *[32]byte) []byte {
+	return secretbox.Seal(nil, pt, nonce, key)
+}
+
+// secretboxOpenChunk is the corresponding open half of secretboxSealChunk.
+func secretboxOpenChunk(sealed []byte, nonce *[24]byte, key *[32]byte) ([]byte, error) {
+	pt, ok := secretbox.Open(nil, sealed, nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("failed to decrypt chunk")
+	}
+	return pt, nil
+}
+
+// GetStream reads back a value written with PutStream, verifying the
+// header's crypto version and returning a reader that rejects a
+// truncated tail (fewer chunks on disk than the header promised) instead
+// of silently returning a short read.
+func (i *EncryptedDB) GetStream(ctx context.Context, key libkb.DbKey) (io.ReadCloser, error) {
+	var header streamHeader
+	found, err := i.Get(ctx, key, &header)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no such stream: %v", key)
+	}
+	if _, err := suiteForVersion(cryptoVersion(header.V)); err != nil {
+		return nil, err
+	}
+
+	// Chunks were sealed under the epoch recorded in the header at write
+	// time, not whatever's current now - a key rotation between PutStream
+	// and GetStream must not change which key we open them with.
+	enckey, err := i.keyProvider.KeyForEpoch(ctx, keyEpoch(header.Epoch))
+	if err != nil {
+		return nil, err
+	}
+
+	db := i.getDB(i.G())
+	return &chunkReader{
+		ctx:    ctx,
+		db:     db,
+		key:    key,
+		header: header,
+		key32:  enckey,
+	}, nil
+}
+
+// chunkReader lazily fetches and decrypts one chunk at a time as its
+// buffer is drained, so GetStream callers can stream a large value
+// without holding the whole plaintext in memory at once.
+type chunkReader struct {
+	ctx    context.Context
+	db     *libkb.JSONLocalDb
+	key    libkb.DbKey
+	header streamHeader
+	key32  [32]byte
+
+	idx int
+	buf []byte
+	pos int
+	off int64 // total plaintext bytes decrypted so far, compared against header.PlainBytes to detect truncation
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.pos >= len(c.buf) {
+		if err := c.fillNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf[c.pos:])
+	c.pos += n
+	return n, nil
+}
+
+func (c *chunkReader) fillNext() error {
+	if c.idx >= c.header.NumChunks {
+		// The header promised NumChunks chunks; if we've consumed them
+		// all but haven't returned PlainBytes worth of data, the stream
+		// was truncated on disk.
+		if c.off < c.header.PlainBytes {
+			return fmt.Errorf("truncated stream: got %d/%d chunks", c.idx, c.header.NumChunks)
+		}
+		return io.EOF
+	}
+	chunkKey := streamChunkKey(c.key, c.idx)
+	sealed, found, err := c.db.GetRaw(chunkKey)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("truncated stream: missing chunk %d/%d", c.idx, c.header.NumChunks)
+	}
+	nonce := chunkNonce(c.header.NoncePfx, uint64(c.idx))
+	pt, err := secretboxOpenChunk(sealed, &nonce, &c.key32)
+	if err != nil {
+		return err
+	}
+	c.buf = pt
+	c.pos = 0
+	c.off += int64(len(pt))
+	c.idx++
+	return nil
+}
+
+func (c *chunkReader) Close() error {
+	return nil
+}
@@ -0,0 +1,150 @@
+package encrypteddb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/keybase/client/go/libkb"
+)
+
+func setupStreamTest(t *testing.T) (*EncryptedDB, libkb.TestContext) {
+	tc := libkb.SetupTest(t, "encrypteddb", 1)
+	key, err := libkb.RandBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fkey [32]byte
+	copy(fkey[:], key)
+	edb := New(tc.G, func(g *libkb.GlobalContext) *libkb.JSONLocalDb {
+		return g.LocalChatDb
+	}, func(context.Context) ([32]byte, error) { return fkey, nil })
+	return edb, tc
+}
+
+func TestPutGetStreamRoundTrip(t *testing.T) {
+	edb, tc := setupStreamTest(t)
+	defer tc.Cleanup()
+	ctx := context.Background()
+
+	key := libkb.DbKey{Typ: libkb.DBChunkstore, Key: "stream-test"}
+	data := bytes.Repeat([]byte("x"), streamChunkSize*2+100)
+	if err := edb.PutStream(ctx, key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := edb.GetStream(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("round-tripped stream doesn't match")
+	}
+}
+
+func TestGetStreamRejectsTruncatedChunks(t *testing.T) {
+	edb, tc := setupStreamTest(t)
+	defer tc.Cleanup()
+	ctx := context.Background()
+
+	key := libkb.DbKey{Typ: libkb.DBChunkstore, Key: "truncated-test"}
+	data := bytes.Repeat([]byte("y"), streamChunkSize*3)
+	if err := edb.PutStream(ctx, key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a chunk lost on disk after the header was written.
+	db := tc.G.LocalChatDb
+	if err := db.Delete(streamChunkKey(key, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := edb.GetStream(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatal("expected a read error for a stream missing its last chunk")
+	}
+}
+
+func TestGetStreamAfterEpochRotationUsesWriteTimeEpoch(t *testing.T) {
+	tc := libkb.SetupTest(t, "encrypteddb", 1)
+	defer tc.Cleanup()
+	ctx := context.Background()
+
+	provider := newTwoEpochKeyProvider(t)
+	edb := NewWithKeyProvider(tc.G, func(g *libkb.GlobalContext) *libkb.JSONLocalDb {
+		return g.LocalChatDb
+	}, provider)
+
+	key := libkb.DbKey{Typ: libkb.DBChunkstore, Key: "rotate-stream-test"}
+	data := bytes.Repeat([]byte("r"), streamChunkSize+50)
+	if err := edb.PutStream(ctx, key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate to a new epoch after writing - GetStream must still open the
+	// chunks with the epoch they were actually sealed under, not whatever
+	// CurrentEpoch reports now.
+	provider.current = 1
+
+	r, err := edb.GetStream(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("stream written before a key rotation should still read back intact after it")
+	}
+}
+
+func TestPutStreamOverwriteCleansUpOrphanedChunks(t *testing.T) {
+	edb, tc := setupStreamTest(t)
+	defer tc.Cleanup()
+	ctx := context.Background()
+
+	key := libkb.DbKey{Typ: libkb.DBChunkstore, Key: "overwrite-test"}
+	long := bytes.Repeat([]byte("z"), streamChunkSize*3)
+	if err := edb.PutStream(ctx, key, bytes.NewReader(long)); err != nil {
+		t.Fatal(err)
+	}
+
+	short := bytes.Repeat([]byte("w"), streamChunkSize)
+	if err := edb.PutStream(ctx, key, bytes.NewReader(short)); err != nil {
+		t.Fatal(err)
+	}
+
+	db := tc.G.LocalChatDb
+	if _, found, err := db.GetRaw(streamChunkKey(key, 1)); err != nil {
+		t.Fatal(err)
+	} else if found {
+		t.Fatal("expected chunk 1 from the old, longer stream to be deleted")
+	}
+	if _, found, err := db.GetRaw(streamChunkKey(key, 2)); err != nil {
+		t.Fatal(err)
+	} else if found {
+		t.Fatal("expected chunk 2 from the old, longer stream to be deleted")
+	}
+
+	r, err := edb.GetStream(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, short) {
+		t.Fatal("expected to read back the shorter, overwritten stream")
+	}
+}